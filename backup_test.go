@@ -0,0 +1,166 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSafeUploadRelPath(t *testing.T) {
+	cases := []struct {
+		rel  string
+		want bool
+	}{
+		{"photo.png", true},
+		{"sub/photo.png", true},
+		{"../../../etc/cron.d/evil", false},
+		{"../secret", false},
+		{"/etc/passwd", false},
+		{"", false},
+	}
+	for _, tc := range cases {
+		if got := safeUploadRelPath(tc.rel); got != tc.want {
+			t.Errorf("safeUploadRelPath(%q) = %v, want %v", tc.rel, got, tc.want)
+		}
+	}
+}
+
+func TestRestoreUploadsRejectsPathTraversal(t *testing.T) {
+	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
+		t.Fatalf("create uploadsDir: %v", err)
+	}
+	escapeTarget := filepath.Join(filepath.Dir(uploadsDir), "evil.txt")
+	os.Remove(escapeTarget)
+	defer os.Remove(escapeTarget)
+
+	entries := map[string][]byte{
+		"uploads/../evil.txt":    []byte("pwned"),
+		"uploads/legit-file.txt": []byte("fine"),
+	}
+	defer os.Remove(filepath.Join(uploadsDir, "legit-file.txt"))
+
+	restoreUploads(entries, true)
+
+	if _, err := os.Stat(escapeTarget); err == nil {
+		t.Fatal("restoreUploads wrote a file outside uploadsDir")
+	}
+	if _, err := os.Stat(filepath.Join(uploadsDir, "legit-file.txt")); err != nil {
+		t.Fatalf("restoreUploads did not write a legitimately-named entry: %v", err)
+	}
+}
+
+func TestVerifyManifestSignatureRejectsTampering(t *testing.T) {
+	manifest := []byte(`[{"name":"subscribers.jsonl","sha256":"abc","size":0}]`)
+	sig := signManifest(manifest)
+
+	entries := map[string][]byte{
+		"manifest.json": manifest,
+		"manifest.sig":  []byte(hex.EncodeToString(sig)),
+	}
+	if err := verifyManifestSignature(entries); err != nil {
+		t.Fatalf("verifyManifestSignature rejected a correctly signed manifest: %v", err)
+	}
+
+	tampered := map[string][]byte{
+		"manifest.json": append(append([]byte{}, manifest...), '\n'),
+		"manifest.sig":  []byte(hex.EncodeToString(sig)),
+	}
+	if err := verifyManifestSignature(tampered); err == nil {
+		t.Fatal("verifyManifestSignature accepted a manifest that doesn't match its signature")
+	}
+
+	noSig := map[string][]byte{"manifest.json": manifest}
+	if err := verifyManifestSignature(noSig); err == nil {
+		t.Fatal("verifyManifestSignature accepted an archive with no manifest.sig at all")
+	}
+}
+
+func TestImportTableRowsRejectsUnknownColumn(t *testing.T) {
+	setupTestDB(t)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("begin tx: %v", err)
+	}
+	defer tx.Rollback()
+
+	row := map[string]interface{}{
+		"id": "victim",
+		"email) VALUES ('pwn'); DROP TABLE subscribers; --": "x",
+	}
+	data, _ := json.Marshal(row)
+	data = append(data, '\n')
+
+	if err := importTableRows(tx, "subscribers", data, false); err == nil {
+		t.Fatal("importTableRows accepted a row with an unknown/malicious column name")
+	}
+}
+
+func TestImportTableRowsAcceptsAllowlistedColumns(t *testing.T) {
+	setupTestDB(t)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("begin tx: %v", err)
+	}
+	defer tx.Rollback()
+
+	row := map[string]interface{}{"id": "sub1", "email": "a@example.com", "status": subscriberConfirmed, "created_at": 1}
+	data, _ := json.Marshal(row)
+	data = append(data, '\n')
+
+	if err := importTableRows(tx, "subscribers", data, false); err != nil {
+		t.Fatalf("importTableRows rejected a valid row: %v", err)
+	}
+
+	var email string
+	if err := tx.QueryRow("SELECT email FROM subscribers WHERE id = ?", "sub1").Scan(&email); err != nil {
+		t.Fatalf("query imported row: %v", err)
+	}
+	if email != "a@example.com" {
+		t.Errorf("imported email = %q, want a@example.com", email)
+	}
+}
+
+func TestWriteAndReadBackupArchiveRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	data := []byte("hello")
+	h := sha256.Sum256(data)
+	if err := tw.WriteHeader(&tar.Header{Name: "sample.jsonl", Mode: 0644, Size: int64(len(data))}); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		t.Fatalf("write data: %v", err)
+	}
+	manifest := []manifestEntry{{Name: "sample.jsonl", SHA256: hex.EncodeToString(h[:]), Size: int64(len(data))}}
+	if err := addManifestToArchive(tw, manifest); err != nil {
+		t.Fatalf("addManifestToArchive: %v", err)
+	}
+	tw.Close()
+	gz.Close()
+
+	gzr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("gzip reader: %v", err)
+	}
+	entries, gotManifest, err := readBackupArchive(gzr)
+	if err != nil {
+		t.Fatalf("readBackupArchive: %v", err)
+	}
+	if err := verifyManifestSignature(entries); err != nil {
+		t.Fatalf("verifyManifestSignature on our own archive: %v", err)
+	}
+	if err := verifyBackupManifest(gotManifest, entries); err != nil {
+		t.Fatalf("verifyBackupManifest on our own archive: %v", err)
+	}
+	if string(entries["sample.jsonl"]) != "hello" {
+		t.Errorf("round-tripped entry = %q, want %q", entries["sample.jsonl"], "hello")
+	}
+}
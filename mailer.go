@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+)
+
+// Mailer is the scheduler's one seam for actually getting a message out the
+// door. doSend and sendPlainEmail both go through a Mailer instead of
+// talking to net/smtp directly, so the transport can be swapped per
+// environment (and faked out in tests) without touching the worker pool.
+// html is empty when the job has no html_template, in which case
+// implementations send a plain text message.
+type Mailer interface {
+	Send(ctx context.Context, from, to, subject, text, html string, headers map[string]string) error
+}
+
+// newMailerFromEnv picks a Mailer implementation based on MAILER
+// (smtp|sendmail|ses|null). With MAILER unset it falls back to the
+// scheduler's long-standing behavior: mock sends unless SMTP_HOST is set.
+func newMailerFromEnv() Mailer {
+	switch strings.ToLower(os.Getenv("MAILER")) {
+	case "smtp":
+		return newSMTPMailerFromEnv()
+	case "sendmail":
+		return newSendmailMailerFromEnv()
+	case "ses":
+		return newSESMailerFromEnv()
+	case "null":
+		return NullMailer{}
+	default:
+		if os.Getenv("SMTP_HOST") == "" {
+			return NullMailer{}
+		}
+		return newSMTPMailerFromEnv()
+	}
+}
+
+// buildMessage assembles an RFC 5322 message with deterministic header
+// ordering, for the implementations that need to hand a wire-format message
+// to their transport (SMTP, sendmail, SES raw send). When html is non-empty
+// it emits a multipart/alternative body with both parts quoted-printable
+// encoded, so non-ASCII content survives transports that aren't 8BITMIME
+// clean; with html empty it emits a plain single-part text message. subject
+// is recipient-templated and so may contain non-ASCII text; it's encoded as
+// an RFC 2047 encoded-word when it isn't plain ASCII.
+func buildMessage(from, to, subject, text, html string, headers map[string]string) string {
+	sb := &strings.Builder{}
+	sb.WriteString(fmt.Sprintf("From: %s\r\n", from))
+	sb.WriteString(fmt.Sprintf("To: %s\r\n", to))
+	sb.WriteString(fmt.Sprintf("Subject: %s\r\n", encodeHeaderWord(subject)))
+	sb.WriteString("MIME-Version: 1.0\r\n")
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sb.WriteString(fmt.Sprintf("%s: %s\r\n", name, headers[name]))
+	}
+
+	if html == "" {
+		sb.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n\r\n")
+		sb.WriteString(text)
+		return sb.String()
+	}
+
+	mw := multipart.NewWriter(sb)
+	sb.WriteString(fmt.Sprintf("Content-Type: multipart/alternative; boundary=%q\r\n\r\n", mw.Boundary()))
+	writeQuotedPrintablePart(mw, "text/plain", text)
+	writeQuotedPrintablePart(mw, "text/html", html)
+	mw.Close()
+	return sb.String()
+}
+
+// encodeHeaderWord returns s unchanged if it's plain ASCII, and otherwise
+// RFC 2047 Q-encodes it so it's safe to write into a header value.
+func encodeHeaderWord(s string) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] > 127 {
+			return mime.QEncoding.Encode("utf-8", s)
+		}
+	}
+	return s
+}
+
+// writeQuotedPrintablePart writes one quoted-printable encoded part of a
+// multipart/alternative message. Encoder errors are ignored: the underlying
+// writer is a strings.Builder, which never fails.
+func writeQuotedPrintablePart(mw *multipart.Writer, contentType, body string) {
+	part, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType + `; charset="utf-8"`},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return
+	}
+	qp := quotedprintable.NewWriter(part)
+	qp.Write([]byte(body))
+	qp.Close()
+}
+
+// ---------------- NullMailer ----------------
+
+// NullMailer just logs. It's the default when SMTP_HOST isn't set, so the
+// scheduler works out of the box without a real mail transport.
+type NullMailer struct{}
+
+func (NullMailer) Send(ctx context.Context, from, to, subject, text, html string, headers map[string]string) error {
+	log.Printf("[MOCK SEND] to=%s subject=%s textLen=%d htmlLen=%d", to, subject, len(text), len(html))
+	return nil
+}
+
+// ---------------- SMTPMailer ----------------
+
+// pooledSMTPConn wraps a persistent SMTP client with a message counter so
+// it can be recycled after MaxMessagesPerConn sends, which some providers
+// cap per connection.
+type pooledSMTPConn struct {
+	client   *smtp.Client
+	messages int
+}
+
+// SMTPMailer talks SMTP directly (rather than through smtp.SendMail) so it
+// can negotiate STARTTLS with a configurable tls.Config instead of the
+// stdlib helper's hardcoded one, and so it can keep a pool of persistent
+// connections across sends instead of dialing fresh for every recipient.
+type SMTPMailer struct {
+	Host               string
+	Port               string
+	User               string
+	Pass               string
+	InsecureSkipVerify bool // only meant for talking to test/dev servers
+	MaxMessagesPerConn int  // <= 0 means a pooled connection is never recycled
+
+	mu   sync.Mutex
+	idle map[string][]*pooledSMTPConn // keyed by "host:port|from"
+}
+
+func newSMTPMailerFromEnv() *SMTPMailer {
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = defaultSMTPPort
+	}
+	insecure, _ := strconv.ParseBool(os.Getenv("SMTP_INSECURE_SKIP_VERIFY"))
+	maxPerConn, _ := strconv.Atoi(os.Getenv("SMTP_MAX_MESSAGES_PER_CONNECTION"))
+	return &SMTPMailer{
+		Host:               os.Getenv("SMTP_HOST"),
+		Port:               port,
+		User:               os.Getenv("SMTP_USER"),
+		Pass:               os.Getenv("SMTP_PASS"),
+		InsecureSkipVerify: insecure,
+		MaxMessagesPerConn: maxPerConn,
+		idle:               make(map[string][]*pooledSMTPConn),
+	}
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, from, to, subject, text, html string, headers map[string]string) error {
+	pc, reused, err := m.acquire(from)
+	if err != nil {
+		return err
+	}
+
+	if err := m.sendOnConn(pc, from, to, subject, text, html, headers); err != nil {
+		pc.client.Close()
+		return err
+	}
+
+	if reused {
+		incSMTPConnectionReuse()
+	}
+	pc.messages++
+	m.release(from, pc)
+	return nil
+}
+
+// acquire returns a connection to use for from, reusing a pooled one if one
+// is idle and still alive, or dialing and authenticating a new one.
+func (m *SMTPMailer) acquire(from string) (pc *pooledSMTPConn, reused bool, err error) {
+	key := m.poolKey(from)
+
+	m.mu.Lock()
+	if conns := m.idle[key]; len(conns) > 0 {
+		pc = conns[len(conns)-1]
+		m.idle[key] = conns[:len(conns)-1]
+	}
+	m.mu.Unlock()
+
+	if pc != nil {
+		// RSET also doubles as a liveness check: if the pooled connection
+		// has gone stale, this fails and we fall through to a fresh dial.
+		if err := pc.client.Reset(); err == nil {
+			return pc, true, nil
+		}
+		pc.client.Close()
+	}
+
+	client, err := m.dial()
+	if err != nil {
+		return nil, false, err
+	}
+	return &pooledSMTPConn{client: client}, false, nil
+}
+
+// release returns pc to the idle pool, unless it has reached
+// MaxMessagesPerConn, in which case it's closed instead so the next acquire
+// dials a fresh one.
+func (m *SMTPMailer) release(from string, pc *pooledSMTPConn) {
+	if m.MaxMessagesPerConn > 0 && pc.messages >= m.MaxMessagesPerConn {
+		pc.client.Quit()
+		return
+	}
+	key := m.poolKey(from)
+	m.mu.Lock()
+	if m.idle == nil {
+		m.idle = make(map[string][]*pooledSMTPConn)
+	}
+	m.idle[key] = append(m.idle[key], pc)
+	m.mu.Unlock()
+}
+
+// Close closes every idle pooled connection. Safe to call repeatedly.
+func (m *SMTPMailer) Close() {
+	m.mu.Lock()
+	idle := m.idle
+	m.idle = make(map[string][]*pooledSMTPConn)
+	m.mu.Unlock()
+
+	for _, conns := range idle {
+		for _, pc := range conns {
+			pc.client.Quit()
+		}
+	}
+}
+
+func (m *SMTPMailer) poolKey(from string) string {
+	return net.JoinHostPort(m.Host, m.Port) + "|" + from
+}
+
+func (m *SMTPMailer) dial() (*smtp.Client, error) {
+	addr := net.JoinHostPort(m.Host, m.Port)
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", addr, err)
+	}
+	if err := c.Hello("localhost"); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		tlsConfig := &tls.Config{ServerName: m.Host, InsecureSkipVerify: m.InsecureSkipVerify}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("starttls: %w", err)
+		}
+	}
+	if m.User != "" {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err := c.Auth(smtp.PlainAuth("", m.User, m.Pass, m.Host)); err != nil {
+				c.Close()
+				return nil, fmt.Errorf("auth: %w", err)
+			}
+		}
+	}
+	return c, nil
+}
+
+func (m *SMTPMailer) sendOnConn(pc *pooledSMTPConn, from, to, subject, text, html string, headers map[string]string) error {
+	c := pc.client
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	msg := buildMessage(from, to, subject, text, html, headers)
+	if _, err := wc.Write([]byte(msg)); err != nil {
+		return err
+	}
+	return wc.Close()
+}
+
+// ---------------- SendmailMailer ----------------
+
+// SendmailMailer shells out to the local `sendmail` binary, for hosts where
+// outbound mail goes through a local MTA rather than a remote SMTP relay.
+type SendmailMailer struct {
+	Path string // defaults to "sendmail" on PATH
+}
+
+func newSendmailMailerFromEnv() *SendmailMailer {
+	path := os.Getenv("SENDMAIL_PATH")
+	if path == "" {
+		path = "sendmail"
+	}
+	return &SendmailMailer{Path: path}
+}
+
+func (m *SendmailMailer) Send(ctx context.Context, from, to, subject, text, html string, headers map[string]string) error {
+	msg := buildMessage(from, to, subject, text, html, headers)
+	cmd := exec.CommandContext(ctx, m.Path, "-f", from, to)
+	cmd.Stdin = strings.NewReader(msg)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("sendmail: %w: %s", err, out)
+	}
+	return nil
+}
+
+// ---------------- SESMailer ----------------
+
+// SESMailer sends through AWS SES v2's raw-message API, which accepts the
+// same RFC 5322 bytes as SMTPMailer, so custom headers like
+// List-Unsubscribe round-trip unchanged.
+type SESMailer struct {
+	client *sesv2.Client
+}
+
+func newSESMailerFromEnv() *SESMailer {
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background())
+	if err != nil {
+		log.Printf("ses mailer: load aws config: %v (sends will fail until this is fixed)", err)
+	}
+	return &SESMailer{client: sesv2.NewFromConfig(cfg)}
+}
+
+func (m *SESMailer) Send(ctx context.Context, from, to, subject, text, html string, headers map[string]string) error {
+	msg := buildMessage(from, to, subject, text, html, headers)
+	_, err := m.client.SendEmail(ctx, &sesv2.SendEmailInput{
+		FromEmailAddress: aws.String(from),
+		Destination:      &types.Destination{ToAddresses: []string{to}},
+		Content: &types.EmailContent{
+			Raw: &types.RawMessage{Data: []byte(msg)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("ses send: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNullMailer(t *testing.T) {
+	m := NullMailer{}
+	if err := m.Send(context.Background(), "from@example.com", "to@example.com", "hi", "body", "", map[string]string{"X-Test": "1"}); err != nil {
+		t.Fatalf("NullMailer.Send returned error: %v", err)
+	}
+}
+
+func TestBuildMessageHeaderRoundTrip(t *testing.T) {
+	headers := map[string]string{
+		"List-Unsubscribe":      "<mailto:unsub@example.com>, <https://example.com/unsubscribe?token=abc>",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+	raw := buildMessage("from@example.com", "to@example.com", "Subject Line", "hello there", "", headers)
+
+	for name, value := range headers {
+		want := fmt.Sprintf("%s: %s\r\n", name, value)
+		if !strings.Contains(raw, want) {
+			t.Errorf("raw message missing header %q: got:\n%s", name, raw)
+		}
+	}
+	if !strings.HasSuffix(raw, "hello there") {
+		t.Errorf("raw message body not preserved: got:\n%s", raw)
+	}
+}
+
+func TestBuildMessageMultipartAlternative(t *testing.T) {
+	raw := buildMessage("from@example.com", "to@example.com", "Subject Line", "hello there", "<p>hello there</p>", nil)
+
+	if !strings.Contains(raw, "Content-Type: multipart/alternative; boundary=") {
+		t.Fatalf("raw message missing multipart/alternative content type: got:\n%s", raw)
+	}
+	if !strings.Contains(raw, "Content-Type: text/plain") || !strings.Contains(raw, "Content-Type: text/html") {
+		t.Errorf("raw message missing one of the text/html parts: got:\n%s", raw)
+	}
+	if !strings.Contains(raw, "hello there") {
+		t.Errorf("raw message missing text part body: got:\n%s", raw)
+	}
+	if !strings.Contains(raw, "<p>hello there</p>") {
+		t.Errorf("raw message missing html part body: got:\n%s", raw)
+	}
+}
+
+func TestBuildMessageSubjectEncoding(t *testing.T) {
+	raw := buildMessage("from@example.com", "to@example.com", "Bonjour André", "hello there", "", nil)
+	if strings.Contains(raw, "Subject: Bonjour André") {
+		t.Fatalf("non-ASCII subject was written raw into the header: got:\n%s", raw)
+	}
+	if !strings.Contains(raw, "Subject: =?utf-8?q?") && !strings.Contains(raw, "Subject: =?utf-8?b?") {
+		t.Fatalf("non-ASCII subject was not RFC 2047 encoded: got:\n%s", raw)
+	}
+
+	raw = buildMessage("from@example.com", "to@example.com", "Subject Line", "hello there", "", nil)
+	if !strings.Contains(raw, "Subject: Subject Line\r\n") {
+		t.Errorf("ASCII subject should be left unencoded: got:\n%s", raw)
+	}
+}
+
+// TestSMTPMailerSend exercises SMTPMailer against a hand-rolled fake SMTP
+// server that requires STARTTLS, verifying TLS negotiation, that custom
+// headers round-trip into the DATA payload, and that a transient (4xx) vs.
+// permanent (5xx) RCPT rejection is classified correctly for the worker's
+// retry/dead-letter decision.
+func TestSMTPMailerSend(t *testing.T) {
+	cases := []struct {
+		name          string
+		rcptCode      int
+		rcptMsg       string
+		wantErr       bool
+		wantPermanent bool
+	}{
+		{name: "accepted", rcptCode: 250, rcptMsg: "OK"},
+		{name: "transient rejection", rcptCode: 450, rcptMsg: "mailbox temporarily unavailable", wantErr: true, wantPermanent: false},
+		{name: "permanent rejection", rcptCode: 550, rcptMsg: "mailbox unavailable", wantErr: true, wantPermanent: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newFakeSMTPServer(t, tc.rcptCode, tc.rcptMsg)
+			defer srv.close()
+
+			mailer := &SMTPMailer{Host: srv.host, Port: srv.port, InsecureSkipVerify: true}
+			defer mailer.Close()
+			headers := map[string]string{"List-Unsubscribe": "<mailto:unsub@example.com>"}
+			err := mailer.Send(context.Background(), "from@example.com", "to@example.com", "subj", "body text", "", headers)
+
+			if tc.wantErr && err == nil {
+				t.Fatalf("expected error, got nil")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.wantErr {
+				var protoErr *textproto.Error
+				if !errors.As(err, &protoErr) {
+					t.Fatalf("expected a *textproto.Error, got %T: %v", err, err)
+				}
+				if got := isPermanentSMTPError(err); got != tc.wantPermanent {
+					t.Errorf("isPermanentSMTPError() = %v, want %v", got, tc.wantPermanent)
+				}
+				return
+			}
+
+			if !srv.sawSTARTTLS {
+				t.Error("mailer did not negotiate STARTTLS")
+			}
+			if !strings.Contains(srv.lastData, "List-Unsubscribe: <mailto:unsub@example.com>") {
+				t.Errorf("captured DATA missing custom header: %q", srv.lastData)
+			}
+			if !strings.Contains(srv.lastData, "body text") {
+				t.Errorf("captured DATA missing body: %q", srv.lastData)
+			}
+		})
+	}
+}
+
+// TestSMTPMailerConnectionReuse sends two messages through the same
+// SMTPMailer and checks that the second one reuses the pooled connection
+// instead of dialing (and STARTTLS-negotiating) again.
+func TestSMTPMailerConnectionReuse(t *testing.T) {
+	srv := newFakeSMTPServer(t, 250, "OK")
+	defer srv.close()
+
+	mailer := &SMTPMailer{Host: srv.host, Port: srv.port, InsecureSkipVerify: true}
+	defer mailer.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := mailer.Send(context.Background(), "from@example.com", "to@example.com", "subj", "body text", "", nil); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+
+	mailer.mu.Lock()
+	idle := mailer.idle[mailer.poolKey("from@example.com")]
+	mailer.mu.Unlock()
+	if len(idle) != 1 {
+		t.Fatalf("expected 1 idle pooled connection after two sends, got %d", len(idle))
+	}
+	if idle[0].messages != 2 {
+		t.Errorf("expected pooled connection to have handled 2 messages, got %d", idle[0].messages)
+	}
+}
+
+// fakeSMTPServer is a minimal single-connection SMTP server good enough to
+// drive SMTPMailer through EHLO/STARTTLS/MAIL/RCPT/DATA.
+type fakeSMTPServer struct {
+	host, port  string
+	listener    net.Listener
+	tlsConfig   *tls.Config
+	rcptCode    int
+	rcptMsg     string
+	sawSTARTTLS bool
+	lastData    string
+	done        chan struct{}
+}
+
+func newFakeSMTPServer(t *testing.T, rcptCode int, rcptMsg string) *fakeSMTPServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	cert := generateSelfSignedCert(t)
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	s := &fakeSMTPServer{
+		host:      host,
+		port:      port,
+		listener:  ln,
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		rcptCode:  rcptCode,
+		rcptMsg:   rcptMsg,
+		done:      make(chan struct{}),
+	}
+	go s.serveOne(t)
+	return s
+}
+
+func (s *fakeSMTPServer) close() {
+	s.listener.Close()
+	<-s.done
+}
+
+func (s *fakeSMTPServer) serveOne(t *testing.T) {
+	defer close(s.done)
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	fmt.Fprintf(rw, "220 fake.smtp ESMTP\r\n")
+	rw.Flush()
+
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		upper := strings.ToUpper(line)
+
+		switch {
+		case strings.HasPrefix(upper, "EHLO"):
+			fmt.Fprintf(rw, "250-fake.smtp\r\n")
+			if !s.sawSTARTTLS {
+				fmt.Fprintf(rw, "250 STARTTLS\r\n")
+			} else {
+				fmt.Fprintf(rw, "250 OK\r\n")
+			}
+		case upper == "STARTTLS":
+			fmt.Fprintf(rw, "220 go ahead\r\n")
+			rw.Flush()
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			rw = bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+			s.sawSTARTTLS = true
+			continue
+		case upper == "RSET":
+			fmt.Fprintf(rw, "250 OK\r\n")
+		case strings.HasPrefix(upper, "MAIL FROM:"):
+			fmt.Fprintf(rw, "250 OK\r\n")
+		case strings.HasPrefix(upper, "RCPT TO:"):
+			fmt.Fprintf(rw, "%d %s\r\n", s.rcptCode, s.rcptMsg)
+			if s.rcptCode >= 400 {
+				rw.Flush()
+				fmt.Fprintf(rw, "221 bye\r\n")
+				rw.Flush()
+				return
+			}
+		case upper == "DATA":
+			fmt.Fprintf(rw, "354 End with .\r\n")
+			rw.Flush()
+			var data strings.Builder
+			for {
+				dataLine, err := rw.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if strings.TrimRight(dataLine, "\r\n") == "." {
+					break
+				}
+				data.WriteString(dataLine)
+			}
+			s.lastData = data.String()
+			fmt.Fprintf(rw, "250 OK: queued\r\n")
+		case upper == "QUIT":
+			fmt.Fprintf(rw, "221 bye\r\n")
+			rw.Flush()
+			return
+		default:
+			fmt.Fprintf(rw, "500 unrecognized command\r\n")
+		}
+		rw.Flush()
+	}
+}
+
+func generateSelfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	serial, _ := cryptorand.Int(cryptorand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("x509 key pair: %v", err)
+	}
+	return cert
+}
@@ -1,14 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
-	"net/smtp"
+	"net/textproto"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -16,47 +24,93 @@ import (
 	"sync"
 	"time"
 
-	_ "modernc.org/sqlite"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	_ "modernc.org/sqlite"
 )
 
 const (
-	dbPath         = "db/scheduler.db"
-	uploadsDir     = "uploads"
-	workerCount    = 4
-	taskQueueSize  = 1000
-	defaultSMTPPort = "587"
+	dbPath             = "db/scheduler.db"
+	uploadsDir         = "uploads"
+	backupsDir         = "backups"
+	workerCount        = 4
+	defaultSMTPPort    = "587"
+	defaultBaseURL     = "http://localhost:8080"
+	defaultUnsubMailto = "unsubscribe@example.com"
+
+	subscriberPending      = "pending"
+	subscriberConfirmed    = "confirmed"
+	subscriberUnsubscribed = "unsubscribed"
+
+	sendQueued     = "queued"
+	sendSending    = "sending"
+	sendSent       = "sent"
+	sendDeadLetter = "dead_letter"
+
+	defaultMaxAttempts = 5
+	defaultJobPriority = 0
+	retryBaseDelay     = 30 * time.Second
+	retryMaxDelay      = 1 * time.Hour
+	pollIdleDelay      = 500 * time.Millisecond
+	throughputWindow   = 20
+
+	backupInterval          = 24 * time.Hour
+	defaultBackupRetainDays = 30
 )
 
 var (
-	db       *sql.DB
-	taskQ    chan SendTask
-	wg       sync.WaitGroup
+	db *sql.DB
+	wg sync.WaitGroup
+
+	// server holds process-wide dependencies, such as the Mailer, that
+	// tests need to swap out. It's a global rather than threaded through
+	// every handler since the handlers here are plain http.HandlerFuncs.
+	server = &Server{Mailer: NullMailer{}, RateLimiter: newDomainRateLimiterFromEnv()}
+
+	throughputMu sync.Mutex
+	// throughputTimes holds, per worker index, the completion timestamps of
+	// its last throughputWindow processed sends (success or failure).
+	throughputTimes = map[int][]time.Time{}
 )
 
+// Server bundles the scheduler's injectable dependencies. main() builds one
+// from the environment; tests run against the package-level default, which
+// uses NullMailer.
+type Server struct {
+	Mailer      Mailer
+	RateLimiter *domainRateLimiter
+}
+
 type SendTask struct {
-	SendID   string
-	JobID    string
-	Email    string
-	Subject  string
-	Body     string
+	SendID           string
+	JobID            string
+	Email            string
+	Subject          string
+	Body             string
+	HTMLBody         string // empty if the job had no html_template
+	UnsubscribeToken string
+	Attempt          int
+	MaxAttempts      int
 }
 
 // job JSON for schedule endpoint
 type JobReq struct {
-	Subject     string `json:"subject"`
-	Body        string `json:"body"`
-	ScheduledAt string `json:"scheduled_at"` // RFC3339 or unix seconds (optional)
+	SubjectTemplate string `json:"subject_template"`
+	TextTemplate    string `json:"text_template"`
+	HTMLTemplate    string `json:"html_template"` // optional; omit for text-only jobs
+	ScheduledAt     string `json:"scheduled_at"`  // RFC3339 or unix seconds (optional)
+	Priority        int    `json:"priority"`      // higher sends first; default 0
 }
 
 func main() {
 	ensureDirs()
 	initDB()
+	server = &Server{Mailer: newMailerFromEnv(), RateLimiter: newDomainRateLimiterFromEnv()}
 	startWorkers(workerCount)
 
 	// start scheduler loop
 	go schedulerLoop()
+	go backupLoop()
 
 	r := mux.NewRouter()
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("templates/assets"))))
@@ -65,7 +119,18 @@ func main() {
 	r.HandleFunc("/upload", uploadCSVHandler).Methods("POST")
 	r.HandleFunc("/schedule", scheduleJobHandler).Methods("POST")
 	r.HandleFunc("/jobs", listJobsHandler).Methods("GET")
-	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request){ w.WriteHeader(200); w.Write([]byte("ok")) }).Methods("GET")
+	r.HandleFunc("/jobs/{id}", jobStatusHandler).Methods("GET")
+	r.HandleFunc("/jobs/{id}/results.csv", jobResultsHandler).Methods("GET")
+	r.HandleFunc("/jobs/preview", jobPreviewHandler).Methods("POST")
+	r.HandleFunc("/subscribe", subscribeHandler).Methods("POST")
+	r.HandleFunc("/confirm", confirmHandler).Methods("GET")
+	r.HandleFunc("/unsubscribe", unsubscribeHandler).Methods("GET", "POST")
+	r.HandleFunc("/sends/dead-letter", listDeadLetterHandler).Methods("GET")
+	r.HandleFunc("/sends/{id}/requeue", requeueSendHandler).Methods("POST")
+	r.HandleFunc("/backup/export", backupExportHandler).Methods("POST")
+	r.HandleFunc("/backup/import", backupImportHandler).Methods("POST")
+	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(200); w.Write([]byte("ok")) }).Methods("GET")
+	r.HandleFunc("/metrics", metricsHandler).Methods("GET")
 
 	addr := ":8080"
 	log.Printf("starting server on %s", addr)
@@ -79,6 +144,9 @@ func ensureDirs() {
 	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
 		log.Fatalf("create uploads dir: %v", err)
 	}
+	if err := os.MkdirAll(backupsDir, 0755); err != nil {
+		log.Fatalf("create backups dir: %v", err)
+	}
 }
 
 // ---------------- DB init ----------------
@@ -89,11 +157,22 @@ func initDB() {
 	if err != nil {
 		log.Fatalf("open db: %v", err)
 	}
+	applySchema()
+}
 
+// applySchema creates the subscribers/jobs/sends tables, indexes, and any
+// forward-compatible column migrations on the global db. Split out of
+// initDB so tests can stand up a throwaway database with the same schema.
+func applySchema() {
 	schema := `
 	CREATE TABLE IF NOT EXISTS subscribers (
 		id TEXT PRIMARY KEY,
 		email TEXT NOT NULL UNIQUE,
+		status TEXT NOT NULL DEFAULT 'pending',
+		confirm_token TEXT,
+		confirmed_at INTEGER,
+		unsubscribe_token TEXT,
+		attributes TEXT,
 		created_at INTEGER NOT NULL
 	);
 
@@ -101,8 +180,10 @@ func initDB() {
 		id TEXT PRIMARY KEY,
 		subject TEXT,
 		body TEXT,
+		html_template TEXT,
 		scheduled_at INTEGER,
 		status TEXT,
+		priority INTEGER NOT NULL DEFAULT 0,
 		created_at INTEGER NOT NULL,
 		completed_at INTEGER
 	);
@@ -114,6 +195,11 @@ func initDB() {
 		email TEXT,
 		status TEXT,
 		attempts INTEGER DEFAULT 0,
+		max_attempts INTEGER NOT NULL DEFAULT 5,
+		next_attempt_at INTEGER NOT NULL DEFAULT 0,
+		rendered_subject TEXT,
+		rendered_text TEXT,
+		rendered_html TEXT,
 		last_error TEXT,
 		created_at INTEGER NOT NULL,
 		sent_at INTEGER
@@ -122,6 +208,40 @@ func initDB() {
 	if _, err := db.Exec(schema); err != nil {
 		log.Fatalf("migrate schema: %v", err)
 	}
+
+	// forward-compatible migrations for databases created before these columns existed
+	migrateColumn("subscribers", "status", "TEXT NOT NULL DEFAULT 'pending'")
+	migrateColumn("subscribers", "confirm_token", "TEXT")
+	migrateColumn("subscribers", "confirmed_at", "INTEGER")
+	migrateColumn("subscribers", "unsubscribe_token", "TEXT")
+	migrateColumn("jobs", "priority", "INTEGER NOT NULL DEFAULT 0")
+	migrateColumn("sends", "max_attempts", "INTEGER NOT NULL DEFAULT 5")
+	migrateColumn("sends", "next_attempt_at", "INTEGER NOT NULL DEFAULT 0")
+	migrateColumn("subscribers", "attributes", "TEXT")
+	migrateColumn("jobs", "html_template", "TEXT")
+	migrateColumn("sends", "rendered_subject", "TEXT")
+	migrateColumn("sends", "rendered_text", "TEXT")
+	migrateColumn("sends", "rendered_html", "TEXT")
+
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_subscribers_confirm_token ON subscribers(confirm_token)"); err != nil {
+		log.Printf("create index confirm_token: %v", err)
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_subscribers_unsubscribe_token ON subscribers(unsubscribe_token)"); err != nil {
+		log.Printf("create index unsubscribe_token: %v", err)
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_sends_claim ON sends(status, next_attempt_at)"); err != nil {
+		log.Printf("create index sends_claim: %v", err)
+	}
+}
+
+// migrateColumn adds column to table if it doesn't already exist. Schema
+// changes land here instead of a migrations framework since the scheduler
+// only ever runs against a single SQLite file.
+func migrateColumn(table, column, definition string) {
+	_, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+		log.Printf("migrate %s.%s: %v", table, column, err)
+	}
 }
 
 // ---------------- Handlers ----------------
@@ -131,8 +251,11 @@ func serveIndex(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "templates/index.html")
 }
 
-// uploadCSVHandler accepts multipart form file field "file" with CSV
-// Each row: first column is email
+// uploadCSVHandler accepts multipart form file field "file" with CSV. The
+// first row is a header; a column named "email" (any case) holds the
+// address, and every other column is stashed as a per-subscriber attribute
+// available to job templates as .Attrs.<column>. If no column is named
+// "email", the first column is used so plain single-column lists still work.
 func uploadCSVHandler(w http.ResponseWriter, r *http.Request) {
 	// limit
 	r.Body = http.MaxBytesReader(w, r.Body, 20<<20) // 20MB
@@ -162,37 +285,80 @@ func uploadCSVHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	reader := csv.NewReader(f)
+	header, err := reader.Read()
+	if err != nil {
+		http.Error(w, "csv missing header row", 400)
+		return
+	}
+	emailCol := 0
+	for i, col := range header {
+		if strings.EqualFold(strings.TrimSpace(col), "email") {
+			emailCol = i
+			break
+		}
+	}
+
 	added := 0
 	for {
 		rec, err := reader.Read()
-		if err == io.EOF { break }
-		if err != nil { log.Println("csv read:", err); continue }
-		if len(rec) == 0 { continue }
-		email := strings.TrimSpace(rec[0])
-		if email == "" { continue }
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Println("csv read:", err)
+			continue
+		}
+		if len(rec) == 0 || emailCol >= len(rec) {
+			continue
+		}
+		email := strings.TrimSpace(rec[emailCol])
+		if email == "" {
+			continue
+		}
+
+		attrs := map[string]string{}
+		for i, col := range header {
+			if i == emailCol || i >= len(rec) {
+				continue
+			}
+			attrs[strings.TrimSpace(col)] = strings.TrimSpace(rec[i])
+		}
+		attrsJSON, err := json.Marshal(attrs)
+		if err != nil {
+			log.Println("marshal attributes:", err)
+			continue
+		}
+
 		id := uuid.New().String()
-		_, err = db.Exec("INSERT INTO subscribers(id,email,created_at) VALUES(?,?,?)", id, email, time.Now().Unix())
+		// CSV imports are administrator-curated lists, so they're considered
+		// already consented and skip the confirm step new /subscribe signups go through.
+		_, err = db.Exec("INSERT INTO subscribers(id,email,status,unsubscribe_token,attributes,created_at) VALUES(?,?,?,?,?,?)",
+			id, email, subscriberConfirmed, sha256Hex(unsubscribeTokenFor(id)), string(attrsJSON), time.Now().Unix())
 		if err != nil {
 			// duplicate or error — ignore duplicates
 			continue
 		}
 		added++
 	}
-	w.Header().Set("Content-Type","application/json")
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"added": added})
 }
 
-// scheduleJobHandler: accept subject, body, scheduled_at
+// scheduleJobHandler: accept subject_template, text_template, html_template, scheduled_at
 func scheduleJobHandler(w http.ResponseWriter, r *http.Request) {
 	var req JobReq
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "invalid json", 400)
 		return
 	}
-	subject := strings.TrimSpace(req.Subject)
-	body := strings.TrimSpace(req.Body)
-	if subject == "" || body == "" {
-		http.Error(w, "subject and body required", 400)
+	subjectTemplate := strings.TrimSpace(req.SubjectTemplate)
+	textTemplate := strings.TrimSpace(req.TextTemplate)
+	if subjectTemplate == "" || textTemplate == "" {
+		http.Error(w, "subject_template and text_template required", 400)
+		return
+	}
+	if _, err := parseJobTemplates(subjectTemplate, textTemplate, req.HTMLTemplate); err != nil {
+		http.Error(w, "invalid template: "+err.Error(), 400)
 		return
 	}
 
@@ -202,7 +368,7 @@ func scheduleJobHandler(w http.ResponseWriter, r *http.Request) {
 	} else {
 		if t, err := time.Parse(time.RFC3339, req.ScheduledAt); err == nil {
 			ts = t.Unix()
-		} else if i, err := strconv.ParseInt(req.ScheduledAt,10,64); err == nil {
+		} else if i, err := strconv.ParseInt(req.ScheduledAt, 10, 64); err == nil {
 			ts = i
 		} else {
 			http.Error(w, "invalid scheduled_at", 400)
@@ -211,44 +377,390 @@ func scheduleJobHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	id := uuid.New().String()
-	_, err := db.Exec("INSERT INTO jobs(id,subject,body,scheduled_at,status,created_at) VALUES(?,?,?,?,?,?)",
-		id, subject, body, ts, "pending", time.Now().Unix())
+	_, err := db.Exec("INSERT INTO jobs(id,subject,body,html_template,scheduled_at,status,priority,created_at) VALUES(?,?,?,?,?,?,?,?)",
+		id, subjectTemplate, textTemplate, nullableString(req.HTMLTemplate), ts, "pending", req.Priority, time.Now().Unix())
 	if err != nil {
 		log.Println("insert job:", err)
 		http.Error(w, "db error", 500)
 		return
 	}
-	w.Header().Set("Content-Type","application/json")
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "scheduled_at": ts})
 }
 
+// jobPreviewHandler renders a job's templates against a sample subscriber
+// without creating a job or sending anything, for POST /jobs/preview.
+func jobPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		JobReq
+		SampleEmail string                 `json:"sample_email"`
+		SampleAttrs map[string]interface{} `json:"sample_attrs"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", 400)
+		return
+	}
+	jt, err := parseJobTemplates(req.SubjectTemplate, req.TextTemplate, req.HTMLTemplate)
+	if err != nil {
+		http.Error(w, "invalid template: "+err.Error(), 400)
+		return
+	}
+
+	email := req.SampleEmail
+	if email == "" {
+		email = "preview@example.com"
+	}
+	ctx := recipientContext{
+		Email:          email,
+		UnsubscribeURL: fmt.Sprintf("%s/unsubscribe?token=preview", baseURL()),
+		Attrs:          req.SampleAttrs,
+	}
+	msg, err := jt.render(ctx)
+	if err != nil {
+		http.Error(w, "render error: "+err.Error(), 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
+
+func nullableString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
 // listJobsHandler: returns jobs
+type jobResp struct {
+	ID             string  `json:"id"`
+	Subject        string  `json:"subject"`
+	Body           string  `json:"body"`
+	ScheduledAt    int64   `json:"scheduled_at"`
+	Status         string  `json:"status"`
+	CreatedAt      int64   `json:"created_at"`
+	CompletedAt    *int64  `json:"completed_at"`
+	PercentageDone float64 `json:"percentage_done"`
+}
+
 func listJobsHandler(w http.ResponseWriter, r *http.Request) {
 	rows, err := db.Query("SELECT id,subject,body,scheduled_at,status,created_at,completed_at FROM jobs ORDER BY created_at DESC")
-	if err != nil { http.Error(w,"db error",500); return }
-	defer rows.Close()
-	type jobResp struct {
-		ID string `json:"id"`
-		Subject string `json:"subject"`
-		Body string `json:"body"`
-		ScheduledAt int64 `json:"scheduled_at"`
-		Status string `json:"status"`
-		CreatedAt int64 `json:"created_at"`
-		CompletedAt *int64 `json:"completed_at"`
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
 	}
+	defer rows.Close()
 	var out []jobResp
 	for rows.Next() {
 		var j jobResp
 		var comp sql.NullInt64
-		if err := rows.Scan(&j.ID,&j.Subject,&j.Body,&j.ScheduledAt,&j.Status,&j.CreatedAt,&comp); err==nil {
-			if comp.Valid { v := comp.Int64; j.CompletedAt = &v }
+		if err := rows.Scan(&j.ID, &j.Subject, &j.Body, &j.ScheduledAt, &j.Status, &j.CreatedAt, &comp); err == nil {
+			if comp.Valid {
+				v := comp.Int64
+				j.CompletedAt = &v
+			}
+			total, done, _, _ := jobSendCounts(j.ID)
+			j.PercentageDone = percentageDone(total, done)
 			out = append(out, j)
 		}
 	}
-	w.Header().Set("Content-Type","application/json")
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(out)
 }
 
+// jobSendCounts returns the total number of sends for a job and how many of
+// them reached a terminal state (sent or dead-lettered), plus the sent and
+// dead-letter counts individually.
+func jobSendCounts(jobID string) (total, done, sent, deadLetter int) {
+	_ = db.QueryRow("SELECT COUNT(1) FROM sends WHERE job_id = ?", jobID).Scan(&total)
+	_ = db.QueryRow("SELECT COUNT(1) FROM sends WHERE job_id = ? AND status = ?", jobID, sendSent).Scan(&sent)
+	_ = db.QueryRow("SELECT COUNT(1) FROM sends WHERE job_id = ? AND status = ?", jobID, sendDeadLetter).Scan(&deadLetter)
+	done = sent + deadLetter
+	return
+}
+
+func percentageDone(total, done int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(done) / float64(total) * 100
+}
+
+// jobStatusResp is modeled on the async-job-status pattern: a status,
+// a percentage_done, an estimated time remaining, and a location URL
+// pointing at the full per-recipient results once the job finishes.
+type jobStatusResp struct {
+	ID              string  `json:"id"`
+	Status          string  `json:"status"`
+	Total           int     `json:"total"`
+	Sent            int     `json:"sent"`
+	Failed          int     `json:"failed"`
+	PercentageDone  float64 `json:"percentage_done"`
+	TimeLeftSeconds *int64  `json:"time_left_seconds"`
+	Location        string  `json:"location"`
+}
+
+// jobStatusHandler serves GET /jobs/{id}.
+func jobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var status string
+	if err := db.QueryRow("SELECT status FROM jobs WHERE id = ?", id).Scan(&status); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "job not found", 404)
+			return
+		}
+		http.Error(w, "db error", 500)
+		return
+	}
+
+	total, done, sent, failed := jobSendCounts(id)
+	resp := jobStatusResp{
+		ID:             id,
+		Status:         status,
+		Total:          total,
+		Sent:           sent,
+		Failed:         failed,
+		PercentageDone: percentageDone(total, done),
+		Location:       fmt.Sprintf("%s/jobs/%s/results.csv", baseURL(), id),
+	}
+
+	if remaining := total - done; remaining > 0 {
+		if rate := estimatedSendsPerSecond(); rate > 0 {
+			secs := int64(float64(remaining) / rate)
+			resp.TimeLeftSeconds = &secs
+		}
+	} else {
+		var zero int64
+		resp.TimeLeftSeconds = &zero
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// jobResultsHandler serves GET /jobs/{id}/results.csv?format=csv|json, a
+// per-recipient dump of send outcomes for the job.
+func jobResultsHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+
+	rows, err := db.Query("SELECT email,status,attempts,COALESCE(last_error,''),sent_at FROM sends WHERE job_id = ? ORDER BY created_at ASC", id)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer rows.Close()
+
+	type result struct {
+		Email     string `json:"email"`
+		Status    string `json:"status"`
+		Attempts  int    `json:"attempts"`
+		LastError string `json:"last_error"`
+		SentAt    *int64 `json:"sent_at"`
+	}
+	var results []result
+	for rows.Next() {
+		var res result
+		var sentAt sql.NullInt64
+		if err := rows.Scan(&res.Email, &res.Status, &res.Attempts, &res.LastError, &sentAt); err != nil {
+			continue
+		}
+		if sentAt.Valid {
+			v := sentAt.Int64
+			res.SentAt = &v
+		}
+		results = append(results, res)
+	}
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-results.csv"`, id))
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"email", "status", "attempts", "last_error", "sent_at"})
+	for _, res := range results {
+		sentAt := ""
+		if res.SentAt != nil {
+			sentAt = strconv.FormatInt(*res.SentAt, 10)
+		}
+		cw.Write([]string{res.Email, res.Status, strconv.Itoa(res.Attempts), res.LastError, sentAt})
+	}
+	cw.Flush()
+}
+
+// ---------------- Subscriber lifecycle ----------------
+
+// SubscribeReq is the body for POST /subscribe
+type SubscribeReq struct {
+	Email string `json:"email"`
+}
+
+// subscribeHandler creates a pending subscriber and emails a confirmation
+// link. Re-subscribing a pending address just resends the confirmation;
+// re-subscribing a confirmed address is a no-op.
+func subscribeHandler(w http.ResponseWriter, r *http.Request) {
+	var req SubscribeReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json", 400)
+		return
+	}
+	email := strings.TrimSpace(strings.ToLower(req.Email))
+	if email == "" {
+		http.Error(w, "email required", 400)
+		return
+	}
+
+	var id, status string
+	err := db.QueryRow("SELECT id, status FROM subscribers WHERE email = ?", email).Scan(&id, &status)
+	switch {
+	case err == sql.ErrNoRows:
+		id = uuid.New().String()
+		unsubHash := sha256Hex(unsubscribeTokenFor(id))
+		_, err = db.Exec("INSERT INTO subscribers(id,email,status,unsubscribe_token,created_at) VALUES(?,?,?,?,?)",
+			id, email, subscriberPending, unsubHash, time.Now().Unix())
+		if err != nil {
+			log.Println("insert subscriber:", err)
+			http.Error(w, "db error", 500)
+			return
+		}
+	case err != nil:
+		log.Println("lookup subscriber:", err)
+		http.Error(w, "db error", 500)
+		return
+	case status == subscriberConfirmed:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "status": status})
+		return
+	}
+
+	confirmToken, err := generateToken()
+	if err != nil {
+		http.Error(w, "token generation failed", 500)
+		return
+	}
+	if _, err := db.Exec("UPDATE subscribers SET confirm_token = ?, status = ? WHERE id = ?", sha256Hex(confirmToken), subscriberPending, id); err != nil {
+		log.Println("set confirm token:", err)
+		http.Error(w, "db error", 500)
+		return
+	}
+
+	if err := sendConfirmationEmail(email, confirmToken); err != nil {
+		log.Println("send confirmation:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "status": subscriberPending})
+}
+
+// confirmHandler marks a pending subscriber confirmed once they click the
+// link from their confirmation email.
+func confirmHandler(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimSpace(r.URL.Query().Get("token"))
+	if token == "" {
+		http.Error(w, "token required", 400)
+		return
+	}
+
+	res, err := db.Exec("UPDATE subscribers SET status = ?, confirmed_at = ?, confirm_token = NULL WHERE confirm_token = ? AND status = ?",
+		subscriberConfirmed, time.Now().Unix(), sha256Hex(token), subscriberPending)
+	if err != nil {
+		log.Println("confirm subscriber:", err)
+		http.Error(w, "db error", 500)
+		return
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		http.Error(w, "invalid or expired token", 404)
+		return
+	}
+	w.Write([]byte("you're confirmed — thanks for subscribing"))
+}
+
+// unsubscribeHandler marks a subscriber unsubscribed. It accepts both GET
+// (a recipient clicking the link) and POST (RFC 8058 one-click unsubscribe
+// clients submitting List-Unsubscribe-Post), since the token carries all
+// the context either way.
+func unsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimSpace(r.URL.Query().Get("token"))
+	if token == "" {
+		http.Error(w, "token required", 400)
+		return
+	}
+
+	res, err := db.Exec("UPDATE subscribers SET status = ? WHERE unsubscribe_token = ?", subscriberUnsubscribed, sha256Hex(token))
+	if err != nil {
+		log.Println("unsubscribe:", err)
+		http.Error(w, "db error", 500)
+		return
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		http.Error(w, "invalid token", 404)
+		return
+	}
+	w.Write([]byte("you've been unsubscribed"))
+}
+
+// generateToken returns a random, URL-safe token suitable for confirm and
+// unsubscribe links.
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := cryptorand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// unsubscribeTokenFor deterministically derives a subscriber's unsubscribe
+// token from their ID, so it can be recomputed for every send without
+// keeping the plaintext around — only its hash is stored, in
+// subscribers.unsubscribe_token.
+func unsubscribeTokenFor(subscriberID string) string {
+	mac := hmac.New(sha256.New, unsubscribeSecret())
+	mac.Write([]byte(subscriberID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func unsubscribeSecret() []byte {
+	if v := os.Getenv("UNSUBSCRIBE_SECRET"); v != "" {
+		return []byte(v)
+	}
+	return []byte("dev-only-insecure-unsubscribe-secret")
+}
+
+func baseURL() string {
+	if v := os.Getenv("PUBLIC_BASE_URL"); v != "" {
+		return strings.TrimRight(v, "/")
+	}
+	return defaultBaseURL
+}
+
+func unsubscribeMailto() string {
+	if v := os.Getenv("UNSUBSCRIBE_MAILTO"); v != "" {
+		return v
+	}
+	return defaultUnsubMailto
+}
+
+func sendConfirmationEmail(email, confirmToken string) error {
+	link := fmt.Sprintf("%s/confirm?token=%s", baseURL(), confirmToken)
+	body := fmt.Sprintf("Please confirm your subscription by visiting:\n\n%s\n\nIf you didn't request this, ignore this email.", link)
+	return sendPlainEmail(email, "Confirm your subscription", body, "")
+}
+
 // ---------------- Scheduler + workers ----------------
 
 func schedulerLoop() {
@@ -260,28 +772,41 @@ func schedulerLoop() {
 
 func enqueueDueJobs() {
 	now := time.Now().Unix()
-	rows, err := db.Query("SELECT id,subject,body FROM jobs WHERE status = ? AND scheduled_at <= ?", "pending", now)
+	rows, err := db.Query("SELECT id,subject,body,COALESCE(html_template,'') FROM jobs WHERE status = ? AND scheduled_at <= ?", "pending", now)
 	if err != nil {
 		log.Println("enqueue query:", err)
 		return
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var id, subject, body string
-		if err := rows.Scan(&id,&subject,&body); err != nil { continue }
+		var id, subject, body, htmlTemplate string
+		if err := rows.Scan(&id, &subject, &body, &htmlTemplate); err != nil {
+			continue
+		}
 		// mark running
 		if _, err := db.Exec("UPDATE jobs SET status = ? WHERE id = ?", "running", id); err != nil {
 			log.Println("mark running:", err)
 			continue
 		}
 		// dispatch
-		go dispatchJob(id, subject, body)
+		go dispatchJob(id, subject, body, htmlTemplate)
 	}
 }
 
-func dispatchJob(jobID, subject, body string) {
-	// create sends for each subscriber and enqueue tasks
-	rows, err := db.Query("SELECT id,email FROM subscribers")
+func dispatchJob(jobID, subjectTemplate, textTemplate, htmlTemplate string) {
+	jt, err := parseJobTemplates(subjectTemplate, textTemplate, htmlTemplate)
+	if err != nil {
+		log.Println("dispatch parse templates:", err)
+		_, _ = db.Exec("UPDATE jobs SET status = ?, completed_at = ? WHERE id = ?", "failed", time.Now().Unix(), jobID)
+		return
+	}
+
+	// create sends for each confirmed subscriber, rendering the job's
+	// templates per recipient. Pending and unsubscribed subscribers never
+	// receive a send. Workers pick these rows up off the sends table
+	// themselves, so dispatchJob only renders and enqueues them, then waits
+	// for them to finish and sets the job's final status.
+	rows, err := db.Query("SELECT id,email,COALESCE(attributes,'') FROM subscribers WHERE status = ?", subscriberConfirmed)
 	if err != nil {
 		log.Println("dispatch subscribers:", err)
 		_, _ = db.Exec("UPDATE jobs SET status = ?, completed_at = ? WHERE id = ?", "failed", time.Now().Unix(), jobID)
@@ -289,37 +814,57 @@ func dispatchJob(jobID, subject, body string) {
 	}
 	defer rows.Close()
 
-	var tasks []SendTask
+	now := time.Now().Unix()
+	queued := 0
 	for rows.Next() {
-		var sid, email string
-		if err := rows.Scan(&sid,&email); err != nil { continue }
+		var sid, email, attrsJSON string
+		if err := rows.Scan(&sid, &email, &attrsJSON); err != nil {
+			continue
+		}
+
+		var attrs map[string]interface{}
+		if attrsJSON != "" {
+			if err := json.Unmarshal([]byte(attrsJSON), &attrs); err != nil {
+				log.Printf("dispatch: bad attributes for subscriber %s: %v", sid, err)
+			}
+		}
+		ctx := recipientContext{
+			Email:          email,
+			UnsubscribeURL: fmt.Sprintf("%s/unsubscribe?token=%s", baseURL(), unsubscribeTokenFor(sid)),
+			Attrs:          attrs,
+		}
+		msg, err := jt.render(ctx)
+		if err != nil {
+			log.Printf("dispatch: render failed for subscriber %s: %v", sid, err)
+			continue
+		}
+
 		sendID := uuid.New().String()
-		_, err := db.Exec("INSERT INTO sends(id,job_id,subscriber_id,email,status,created_at,attempts) VALUES(?,?,?,?,?,?,0)", sendID, jobID, sid, email, "queued", time.Now().Unix())
-		if err != nil { continue }
-		tasks = append(tasks, SendTask{
-			SendID: sendID,
-			JobID: jobID,
-			Email: email,
-			Subject: subject,
-			Body: body,
-		})
+		_, err = db.Exec(`INSERT INTO sends(id,job_id,subscriber_id,email,status,attempts,max_attempts,next_attempt_at,rendered_subject,rendered_text,rendered_html,created_at)
+			VALUES(?,?,?,?,?,0,?,?,?,?,?,?)`, sendID, jobID, sid, email, sendQueued, defaultMaxAttempts, now, msg.Subject, msg.Text, nullableString(msg.HTML), now)
+		if err != nil {
+			continue
+		}
+		queued++
 	}
-
-	for _, t := range tasks {
-		taskQ <- t
+	if queued == 0 {
+		_, _ = db.Exec("UPDATE jobs SET status = ?, completed_at = ? WHERE id = ?", "completed", time.Now().Unix(), jobID)
+		return
 	}
 
-	// wait until sends for this job finish (simple polling)
+	// wait until every send for this job reaches a terminal state (simple polling)
 	for {
 		var remaining int
-		_ = db.QueryRow("SELECT COUNT(1) FROM sends WHERE job_id = ? AND status IN ('queued','sending')", jobID).Scan(&remaining)
-		if remaining == 0 { break }
+		_ = db.QueryRow("SELECT COUNT(1) FROM sends WHERE job_id = ? AND status IN (?, ?)", jobID, sendQueued, sendSending).Scan(&remaining)
+		if remaining == 0 {
+			break
+		}
 		time.Sleep(1 * time.Second)
 	}
 
 	// finalize
 	var failed int
-	_ = db.QueryRow("SELECT COUNT(1) FROM sends WHERE job_id = ? AND status = ?", jobID, "failed").Scan(&failed)
+	_ = db.QueryRow("SELECT COUNT(1) FROM sends WHERE job_id = ? AND status = ?", jobID, sendDeadLetter).Scan(&failed)
 	if failed > 0 {
 		_, _ = db.Exec("UPDATE jobs SET status = ?, completed_at = ? WHERE id = ?", "completed_with_errors", time.Now().Unix(), jobID)
 	} else {
@@ -330,62 +875,241 @@ func dispatchJob(jobID, subject, body string) {
 // workers
 
 func startWorkers(n int) {
-	taskQ = make(chan SendTask, taskQueueSize)
-	for i:=0;i<n;i++ {
+	for i := 0; i < n; i++ {
 		wg.Add(1)
-		go worker(i+1)
+		go worker(i + 1)
 	}
 }
 
+// worker repeatedly claims the highest-priority, earliest-due send and
+// processes it. There's no shared channel anymore — the sends table is the
+// queue, which is what lets a restart pick up exactly where it left off.
 func worker(idx int) {
 	defer wg.Done()
-	for t := range taskQ {
-		// mark sending
-		_, _ = db.Exec("UPDATE sends SET status = ?, attempts = attempts+1 WHERE id = ?", "sending", t.SendID)
+	for {
+		t, ok := claimNextSend()
+		if !ok {
+			time.Sleep(pollIdleDelay)
+			continue
+		}
+
+		if err := server.RateLimiter.wait(context.Background(), t.Email); err != nil {
+			requeueOrDeadLetter(t, err)
+			log.Printf("[Worker-%d] rate limiter wait job=%s email=%s: %v", idx, t.JobID, t.Email, err)
+			continue
+		}
+
 		err := doSend(t)
-		if err != nil {
-			_, _ = db.Exec("UPDATE sends SET status = ?, last_error = ? WHERE id = ?", "failed", err.Error(), t.SendID)
-			log.Printf("[Worker-%d] send failed job=%s email=%s err=%v", idx, t.JobID, t.Email, err)
+		recordThroughput(idx)
+		if err == nil {
+			_, _ = db.Exec("UPDATE sends SET status = ?, sent_at = ? WHERE id = ?", sendSent, time.Now().Unix(), t.SendID)
+			incSendsTotal()
+			log.Printf("[Worker-%d] sent job=%s email=%s", idx, t.JobID, t.Email)
+			continue
+		}
+
+		requeueOrDeadLetter(t, err)
+		incSendsFailed(failureReason(err))
+		log.Printf("[Worker-%d] send failed job=%s email=%s attempt=%d err=%v", idx, t.JobID, t.Email, t.Attempt, err)
+	}
+}
+
+// recordThroughput appends a completion timestamp to worker idx's rolling
+// window, trimming it back down to throughputWindow entries.
+func recordThroughput(idx int) {
+	throughputMu.Lock()
+	defer throughputMu.Unlock()
+	times := append(throughputTimes[idx], time.Now())
+	if len(times) > throughputWindow {
+		times = times[len(times)-throughputWindow:]
+	}
+	throughputTimes[idx] = times
+}
+
+// estimatedSendsPerSecond sums the per-worker throughput observed over each
+// worker's rolling window into an overall sends/sec estimate, used to
+// project time_left_seconds for a running job.
+func estimatedSendsPerSecond() float64 {
+	throughputMu.Lock()
+	defer throughputMu.Unlock()
+
+	var total float64
+	for _, times := range throughputTimes {
+		if len(times) < 2 {
 			continue
 		}
-		_, _ = db.Exec("UPDATE sends SET status = ?, sent_at = ? WHERE id = ?", "sent", time.Now().Unix(), t.SendID)
-		log.Printf("[Worker-%d] sent job=%s email=%s", idx, t.JobID, t.Email)
+		span := times[len(times)-1].Sub(times[0]).Seconds()
+		if span <= 0 {
+			continue
+		}
+		total += float64(len(times)-1) / span
+	}
+	return total
+}
+
+// claimNextSend picks the highest-priority, earliest-due queued send across
+// all jobs and marks it "sending" so no other worker claims it too. Priority
+// lives on the job, not the send, so it's joined in at claim time.
+func claimNextSend() (SendTask, bool) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Println("claim begin tx:", err)
+		return SendTask{}, false
+	}
+	defer tx.Rollback()
+
+	var t SendTask
+	now := time.Now().Unix()
+	row := tx.QueryRow(`
+		SELECT s.id, s.job_id, s.subscriber_id, s.email, s.rendered_subject, s.rendered_text, COALESCE(s.rendered_html, ''), s.attempts, s.max_attempts
+		FROM sends s JOIN jobs j ON j.id = s.job_id
+		WHERE s.status = ? AND s.next_attempt_at <= ?
+		ORDER BY j.priority DESC, s.next_attempt_at ASC
+		LIMIT 1`, sendQueued, now)
+
+	var subscriberID string
+	if err := row.Scan(&t.SendID, &t.JobID, &subscriberID, &t.Email, &t.Subject, &t.Body, &t.HTMLBody, &t.Attempt, &t.MaxAttempts); err != nil {
+		if err != sql.ErrNoRows {
+			log.Println("claim select:", err)
+		}
+		return SendTask{}, false
+	}
+	t.UnsubscribeToken = unsubscribeTokenFor(subscriberID)
+	t.Attempt++
+
+	if _, err := tx.Exec("UPDATE sends SET status = ?, attempts = ? WHERE id = ?", sendSending, t.Attempt, t.SendID); err != nil {
+		log.Println("claim update:", err)
+		return SendTask{}, false
+	}
+	if err := tx.Commit(); err != nil {
+		log.Println("claim commit:", err)
+		return SendTask{}, false
+	}
+	return t, true
+}
+
+// requeueOrDeadLetter schedules a transient failure for retry with
+// exponential backoff, or moves the send to the dead letter queue once
+// max_attempts is exhausted or the SMTP server reports a permanent (5xx)
+// rejection.
+func requeueOrDeadLetter(t SendTask, sendErr error) {
+	if t.Attempt >= t.MaxAttempts || isPermanentSMTPError(sendErr) {
+		_, _ = db.Exec("UPDATE sends SET status = ?, last_error = ? WHERE id = ?", sendDeadLetter, sendErr.Error(), t.SendID)
+		return
+	}
+	next := time.Now().Add(backoffDelay(t.Attempt)).Unix()
+	_, _ = db.Exec("UPDATE sends SET status = ?, next_attempt_at = ?, last_error = ? WHERE id = ?", sendQueued, next, sendErr.Error(), t.SendID)
+}
+
+// backoffDelay is base * 2^attempts, capped at retryMaxDelay, with up to
+// one base-delay of jitter so a burst of failures doesn't retry in lockstep.
+func backoffDelay(attempt int) time.Duration {
+	d := retryBaseDelay * time.Duration(1<<uint(attempt))
+	if d > retryMaxDelay || d <= 0 {
+		d = retryMaxDelay
+	}
+	return d + time.Duration(rand.Int63n(int64(retryBaseDelay)))
+}
+
+// isPermanentSMTPError reports whether err is an SMTP 5xx reply, which
+// retrying will never fix.
+func isPermanentSMTPError(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code/100 == 5
+	}
+	return false
+}
+
+// failureReason labels a send failure for the sends_failed_total metric.
+func failureReason(err error) string {
+	if isPermanentSMTPError(err) {
+		return "permanent"
+	}
+	return "transient"
+}
+
+// ---------------- dead letter queue ----------------
+
+type deadLetterSend struct {
+	ID        string `json:"id"`
+	JobID     string `json:"job_id"`
+	Email     string `json:"email"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error"`
+}
+
+// listDeadLetterHandler returns sends that exhausted their retries or were
+// permanently rejected, so an operator can inspect and requeue them.
+func listDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query("SELECT id,job_id,email,attempts,COALESCE(last_error,'') FROM sends WHERE status = ? ORDER BY created_at DESC", sendDeadLetter)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	defer rows.Close()
+
+	var out []deadLetterSend
+	for rows.Next() {
+		var d deadLetterSend
+		if err := rows.Scan(&d.ID, &d.JobID, &d.Email, &d.Attempts, &d.LastError); err == nil {
+			out = append(out, d)
+		}
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// requeueSendHandler resets a dead-lettered send back to queued with a
+// fresh attempt counter, for POST /sends/{id}/requeue.
+func requeueSendHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	res, err := db.Exec("UPDATE sends SET status = ?, attempts = 0, next_attempt_at = ?, last_error = NULL WHERE id = ? AND status = ?",
+		sendQueued, time.Now().Unix(), id, sendDeadLetter)
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	n, _ := res.RowsAffected()
+	if n == 0 {
+		http.Error(w, "send not found or not dead-lettered", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "status": sendQueued})
 }
 
 // ---------------- Email sending ----------------
 
 func doSend(t SendTask) error {
-	// if SMTP env not set, mock send
-	smtpHost := os.Getenv("SMTP_HOST")
-	smtpPort := os.Getenv("SMTP_PORT")
-	smtpUser := os.Getenv("SMTP_USER")
-	smtpPass := os.Getenv("SMTP_PASS")
 	from := os.Getenv("SMTP_FROM")
-	if from == "" { from = "no-reply@example.com" }
-
-	if smtpHost == "" {
-		// mock
-		log.Printf("[MOCK SEND] to=%s subject=%s bodyLen=%d", t.Email, t.Subject, len(t.Body))
-		return nil
+	if from == "" {
+		from = "no-reply@example.com"
 	}
-
-	if smtpPort == "" { smtpPort = defaultSMTPPort }
-	addr := fmt.Sprintf("%s:%s", smtpHost, smtpPort)
-	msg := buildMessage(from, t.Email, t.Subject, t.Body)
-	auth := smtp.PlainAuth("", smtpUser, smtpPass, smtpHost)
-	return smtp.SendMail(addr, auth, from, []string{t.Email}, []byte(msg))
+	return server.Mailer.Send(context.Background(), from, t.Email, t.Subject, t.Body, t.HTMLBody, unsubscribeHeaders(t.UnsubscribeToken))
 }
 
-func buildMessage(from, to, subject, body string) string {
-	sb := &strings.Builder{}
-	sb.WriteString(fmt.Sprintf("From: %s\r\n", from))
-	sb.WriteString(fmt.Sprintf("To: %s\r\n", to))
-	sb.WriteString(fmt.Sprintf("Subject: %s\r\n", subject))
-	sb.WriteString("MIME-Version: 1.0\r\n")
-	sb.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
-	sb.WriteString("\r\n")
-	sb.WriteString(body)
-	return sb.String()
+// sendPlainEmail sends a one-off transactional email (confirmation, etc.)
+// outside of the job/worker pipeline, via the same configured Mailer. It has
+// no html_template of its own, so it always goes out as plain text.
+func sendPlainEmail(to, subject, body, unsubscribeToken string) error {
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = "no-reply@example.com"
+	}
+	return server.Mailer.Send(context.Background(), from, to, subject, body, "", unsubscribeHeaders(unsubscribeToken))
 }
 
+// unsubscribeHeaders returns the RFC 8058 one-click unsubscribe headers for
+// a recipient's unsubscribe token, or nil if the message has none (e.g. the
+// confirmation email itself, before there's anything to unsubscribe from).
+func unsubscribeHeaders(unsubscribeToken string) map[string]string {
+	if unsubscribeToken == "" {
+		return nil
+	}
+	unsubURL := fmt.Sprintf("%s/unsubscribe?token=%s", baseURL(), unsubscribeToken)
+	return map[string]string{
+		"List-Unsubscribe":      fmt.Sprintf("<mailto:%s>, <%s>", unsubscribeMailto(), unsubURL),
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+// jsonBody marshals v and wraps it as a request body for handler tests.
+func jsonBody(t *testing.T, v interface{}) io.Reader {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshal json body: %v", err)
+	}
+	return bytes.NewReader(b)
+}
+
+// setupTestDB points the global db at a fresh in-memory SQLite database with
+// the scheduler's schema applied, and restores the previous db on cleanup.
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	prev := db
+	conn, err := sql.Open("sqlite", "file::memory:?cache=shared")
+	if err != nil {
+		t.Fatalf("open test db: %v", err)
+	}
+	// Force the pool down to a single connection for the life of the test,
+	// so every query in it runs on the same connection.
+	conn.SetMaxOpenConns(1)
+	db = conn
+	applySchema()
+	t.Cleanup(func() {
+		conn.Close()
+		db = prev
+	})
+}
+
+func insertJob(t *testing.T, id string, priority int) {
+	t.Helper()
+	if _, err := db.Exec("INSERT INTO jobs(id,subject,body,scheduled_at,status,priority,created_at) VALUES(?,?,?,?,?,?,?)",
+		id, "subj", "body", time.Now().Unix(), "running", priority, time.Now().Unix()); err != nil {
+		t.Fatalf("insert job: %v", err)
+	}
+}
+
+func insertSend(t *testing.T, id, jobID, email string, maxAttempts int) {
+	t.Helper()
+	if _, err := db.Exec(`INSERT INTO sends(id,job_id,subscriber_id,email,status,attempts,max_attempts,next_attempt_at,rendered_subject,rendered_text,created_at)
+		VALUES(?,?,?,?,?,0,?,0,?,?,?)`, id, jobID, id, email, sendQueued, maxAttempts, "subj", "body", time.Now().Unix()); err != nil {
+		t.Fatalf("insert send: %v", err)
+	}
+}
+
+func TestClaimNextSendOrdersByPriority(t *testing.T) {
+	setupTestDB(t)
+	insertJob(t, "job-low", 0)
+	insertJob(t, "job-high", 10)
+	insertSend(t, "send-low", "job-low", "low@example.com", defaultMaxAttempts)
+	insertSend(t, "send-high", "job-high", "high@example.com", defaultMaxAttempts)
+
+	task, ok := claimNextSend()
+	if !ok {
+		t.Fatal("claimNextSend returned false, want a claimed send")
+	}
+	if task.SendID != "send-high" {
+		t.Errorf("claimNextSend picked %q, want the higher-priority job's send", task.SendID)
+	}
+
+	var status string
+	if err := db.QueryRow("SELECT status FROM sends WHERE id = ?", task.SendID).Scan(&status); err != nil {
+		t.Fatalf("query claimed send status: %v", err)
+	}
+	if status != sendSending {
+		t.Errorf("claimed send status = %q, want %q", status, sendSending)
+	}
+}
+
+func TestClaimNextSendNoneDue(t *testing.T) {
+	setupTestDB(t)
+	if _, ok := claimNextSend(); ok {
+		t.Fatal("claimNextSend returned true with no queued sends")
+	}
+}
+
+func TestRequeueOrDeadLetterPermanentError(t *testing.T) {
+	setupTestDB(t)
+	insertJob(t, "job1", 0)
+	insertSend(t, "send1", "job1", "a@example.com", defaultMaxAttempts)
+
+	task := SendTask{SendID: "send1", Attempt: 1, MaxAttempts: defaultMaxAttempts}
+	permErr := &textproto.Error{Code: 550, Msg: "mailbox unavailable"}
+	requeueOrDeadLetter(task, permErr)
+
+	var status string
+	if err := db.QueryRow("SELECT status FROM sends WHERE id = ?", task.SendID).Scan(&status); err != nil {
+		t.Fatalf("query send: %v", err)
+	}
+	if status != sendDeadLetter {
+		t.Errorf("status after permanent error = %q, want %q", status, sendDeadLetter)
+	}
+}
+
+func TestRequeueOrDeadLetterTransientError(t *testing.T) {
+	setupTestDB(t)
+	insertJob(t, "job1", 0)
+	insertSend(t, "send1", "job1", "a@example.com", defaultMaxAttempts)
+
+	task := SendTask{SendID: "send1", Attempt: 1, MaxAttempts: defaultMaxAttempts}
+	requeueOrDeadLetter(task, errors.New("connection reset"))
+
+	var status string
+	var nextAttemptAt int64
+	if err := db.QueryRow("SELECT status, next_attempt_at FROM sends WHERE id = ?", task.SendID).Scan(&status, &nextAttemptAt); err != nil {
+		t.Fatalf("query send: %v", err)
+	}
+	if status != sendQueued {
+		t.Errorf("status after transient error = %q, want %q", status, sendQueued)
+	}
+	if nextAttemptAt <= time.Now().Unix() {
+		t.Errorf("next_attempt_at = %d, want it scheduled in the future", nextAttemptAt)
+	}
+}
+
+func TestRequeueOrDeadLetterAttemptsExhausted(t *testing.T) {
+	setupTestDB(t)
+	insertJob(t, "job1", 0)
+	insertSend(t, "send1", "job1", "a@example.com", 3)
+
+	task := SendTask{SendID: "send1", Attempt: 3, MaxAttempts: 3}
+	requeueOrDeadLetter(task, errors.New("still failing"))
+
+	var status string
+	if err := db.QueryRow("SELECT status FROM sends WHERE id = ?", task.SendID).Scan(&status); err != nil {
+		t.Fatalf("query send: %v", err)
+	}
+	if status != sendDeadLetter {
+		t.Errorf("status after exhausting attempts = %q, want %q", status, sendDeadLetter)
+	}
+}
+
+func TestBackoffDelayGrowsAndCaps(t *testing.T) {
+	d0 := backoffDelay(0)
+	if d0 < retryBaseDelay || d0 >= 2*retryBaseDelay {
+		t.Errorf("backoffDelay(0) = %v, want in [%v, %v)", d0, retryBaseDelay, 2*retryBaseDelay)
+	}
+
+	big := backoffDelay(20)
+	if big < retryMaxDelay || big >= 2*retryMaxDelay {
+		t.Errorf("backoffDelay(20) = %v, want capped near %v", big, retryMaxDelay)
+	}
+}
+
+func TestSubscribeConfirmUnsubscribeLifecycle(t *testing.T) {
+	setupTestDB(t)
+
+	jsonReq := httptest.NewRequest("POST", "/subscribe", jsonBody(t, SubscribeReq{Email: "alice@example.com"}))
+	jsonReq.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	subscribeHandler(rec, jsonReq)
+	if rec.Code != 200 {
+		t.Fatalf("subscribeHandler status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+
+	var id, status, confirmTokenHash string
+	if err := db.QueryRow("SELECT id, status, COALESCE(confirm_token,'') FROM subscribers WHERE email = ?", "alice@example.com").
+		Scan(&id, &status, &confirmTokenHash); err != nil {
+		t.Fatalf("query subscriber: %v", err)
+	}
+	if status != subscriberPending {
+		t.Fatalf("status after subscribe = %q, want %q", status, subscriberPending)
+	}
+	if confirmTokenHash == "" {
+		t.Fatalf("subscribe did not set a confirm_token")
+	}
+
+	// confirmHandler only ever sees the plaintext token via the emailed link,
+	// never the hash stored in the DB. There's no way to reverse sha256Hex,
+	// so drive confirm through a token we control by writing its hash
+	// directly, mirroring what subscribeHandler did.
+	const plainToken = "test-confirm-token"
+	if _, err := db.Exec("UPDATE subscribers SET confirm_token = ? WHERE id = ?", sha256Hex(plainToken), id); err != nil {
+		t.Fatalf("set confirm token: %v", err)
+	}
+
+	confirmReq := httptest.NewRequest("GET", "/confirm?token="+plainToken, nil)
+	confirmRec := httptest.NewRecorder()
+	confirmHandler(confirmRec, confirmReq)
+	if confirmRec.Code != 200 {
+		t.Fatalf("confirmHandler status = %d, want 200: %s", confirmRec.Code, confirmRec.Body.String())
+	}
+
+	if err := db.QueryRow("SELECT status FROM subscribers WHERE id = ?", id).Scan(&status); err != nil {
+		t.Fatalf("query subscriber after confirm: %v", err)
+	}
+	if status != subscriberConfirmed {
+		t.Fatalf("status after confirm = %q, want %q", status, subscriberConfirmed)
+	}
+
+	// unsubscribe via the deterministic token derived from the subscriber id
+	unsubToken := unsubscribeTokenFor(id)
+	if _, err := db.Exec("UPDATE subscribers SET unsubscribe_token = ? WHERE id = ?", sha256Hex(unsubToken), id); err != nil {
+		t.Fatalf("set unsubscribe token: %v", err)
+	}
+	unsubReq := httptest.NewRequest("GET", "/unsubscribe?token="+unsubToken, nil)
+	unsubRec := httptest.NewRecorder()
+	unsubscribeHandler(unsubRec, unsubReq)
+	if unsubRec.Code != 200 {
+		t.Fatalf("unsubscribeHandler status = %d, want 200: %s", unsubRec.Code, unsubRec.Body.String())
+	}
+
+	if err := db.QueryRow("SELECT status FROM subscribers WHERE id = ?", id).Scan(&status); err != nil {
+		t.Fatalf("query subscriber after unsubscribe: %v", err)
+	}
+	if status != subscriberUnsubscribed {
+		t.Fatalf("status after unsubscribe = %q, want %q", status, subscriberUnsubscribed)
+	}
+}
+
+func TestConfirmHandlerRejectsUnknownToken(t *testing.T) {
+	setupTestDB(t)
+	req := httptest.NewRequest("GET", "/confirm?token=does-not-exist", nil)
+	rec := httptest.NewRecorder()
+	confirmHandler(rec, req)
+	if rec.Code != 404 {
+		t.Errorf("confirmHandler status = %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Process-wide send counters exposed at /metrics in a minimal Prometheus
+// text exposition format. Three counters don't justify pulling in
+// client_golang, so this just formats them by hand.
+var (
+	sendsTotal               int64
+	smtpConnectionReuseTotal int64
+
+	sendsFailedMu     sync.Mutex
+	sendsFailedReason = map[string]int64{}
+)
+
+func incSendsTotal() {
+	atomic.AddInt64(&sendsTotal, 1)
+}
+
+func incSMTPConnectionReuse() {
+	atomic.AddInt64(&smtpConnectionReuseTotal, 1)
+}
+
+// incSendsFailed records a failed send under reason ("permanent" or
+// "transient", see failureReason).
+func incSendsFailed(reason string) {
+	sendsFailedMu.Lock()
+	defer sendsFailedMu.Unlock()
+	sendsFailedReason[reason]++
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintf(w, "# HELP sends_total Total number of sends that completed successfully.\n")
+	fmt.Fprintf(w, "# TYPE sends_total counter\n")
+	fmt.Fprintf(w, "sends_total %d\n", atomic.LoadInt64(&sendsTotal))
+
+	fmt.Fprintf(w, "# HELP sends_failed_total Total number of sends that failed, by reason.\n")
+	fmt.Fprintf(w, "# TYPE sends_failed_total counter\n")
+	sendsFailedMu.Lock()
+	reasons := make([]string, 0, len(sendsFailedReason))
+	for reason := range sendsFailedReason {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "sends_failed_total{reason=%q} %d\n", reason, sendsFailedReason[reason])
+	}
+	sendsFailedMu.Unlock()
+
+	fmt.Fprintf(w, "# HELP smtp_connection_reuse_total Total number of SMTP sends that reused a pooled connection.\n")
+	fmt.Fprintf(w, "# TYPE smtp_connection_reuse_total counter\n")
+	fmt.Fprintf(w, "smtp_connection_reuse_total %d\n", atomic.LoadInt64(&smtpConnectionReuseTotal))
+}
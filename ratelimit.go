@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// domainRateLimiter throttles outbound sends with one global token bucket
+// plus one bucket per recipient domain, so a single large job can't blow
+// through a provider's per-domain rate limit (e.g. gmail.com) even though
+// the global bucket still has room.
+type domainRateLimiter struct {
+	global *rate.Limiter // nil disables the global limit
+
+	mu          sync.Mutex
+	perDomain   map[string]*rate.Limiter
+	domainLimit rate.Limit // <= 0 disables per-domain limits
+	domainBurst int
+}
+
+// newDomainRateLimiterFromEnv reads SMTP_RATE_PER_SEC/SMTP_BURST for the
+// global bucket and SMTP_DOMAIN_RATE_PER_SEC/SMTP_DOMAIN_BURST for the
+// per-domain buckets. SMTP_RATE_PER_SEC unset or 0 disables the global
+// limit; the per-domain limit defaults to 20 msgs/s per domain, which is a
+// conservative default most providers tolerate.
+func newDomainRateLimiterFromEnv() *domainRateLimiter {
+	var global *rate.Limiter
+	if r := parseEnvFloat("SMTP_RATE_PER_SEC", 0); r > 0 {
+		global = rate.NewLimiter(rate.Limit(r), parseEnvInt("SMTP_BURST", 1))
+	}
+	return &domainRateLimiter{
+		global:      global,
+		perDomain:   make(map[string]*rate.Limiter),
+		domainLimit: rate.Limit(parseEnvFloat("SMTP_DOMAIN_RATE_PER_SEC", 20)),
+		domainBurst: parseEnvInt("SMTP_DOMAIN_BURST", 5),
+	}
+}
+
+// wait blocks until both the global bucket and to's domain bucket have a
+// token available, or ctx is done.
+func (l *domainRateLimiter) wait(ctx context.Context, to string) error {
+	if l.global != nil {
+		if err := l.global.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	if l.domainLimit <= 0 {
+		return nil
+	}
+	return l.limiterFor(to).Wait(ctx)
+}
+
+// limiterFor returns to's per-domain bucket, creating it on first use.
+func (l *domainRateLimiter) limiterFor(to string) *rate.Limiter {
+	domain := emailDomain(to)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lim, ok := l.perDomain[domain]
+	if !ok {
+		lim = rate.NewLimiter(l.domainLimit, l.domainBurst)
+		l.perDomain[domain] = lim
+	}
+	return lim
+}
+
+// emailDomain returns the lowercased domain part of an email address, or
+// "" if it doesn't look like one.
+func emailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(email[at+1:])
+}
+
+func parseEnvFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return def
+	}
+	return f
+}
+
+func parseEnvInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return def
+	}
+	return n
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+)
+
+// templateFuncs is the Sprig function set available to subject/text/html
+// job templates, so senders get the usual string/default/date helpers
+// without the scheduler having to reinvent them.
+func templateFuncs() template.FuncMap {
+	return sprig.TxtFuncMap()
+}
+
+// recipientContext is what a job template renders against. `.` in a
+// template is one of these.
+type recipientContext struct {
+	Email          string
+	UnsubscribeURL string
+	Attrs          map[string]interface{}
+}
+
+// renderedMessage is the output of rendering a job's templates for one
+// recipient.
+type renderedMessage struct {
+	Subject string
+	Text    string
+	HTML    string // empty if the job had no html_template
+}
+
+// jobTemplates holds a job's parsed subject/text/html templates so they're
+// compiled once per dispatch instead of once per recipient.
+type jobTemplates struct {
+	subject *template.Template
+	text    *template.Template
+	html    *htmltemplate.Template // nil if the job has no HTML variant
+}
+
+// parseJobTemplates compiles a job's subject/text/html template sources.
+// htmlSrc may be empty, meaning the job is text-only.
+func parseJobTemplates(subjectSrc, textSrc, htmlSrc string) (*jobTemplates, error) {
+	subjectTmpl, err := template.New("subject").Funcs(templateFuncs()).Parse(subjectSrc)
+	if err != nil {
+		return nil, err
+	}
+	textTmpl, err := template.New("text").Funcs(templateFuncs()).Parse(textSrc)
+	if err != nil {
+		return nil, err
+	}
+	jt := &jobTemplates{subject: subjectTmpl, text: textTmpl}
+
+	if htmlSrc != "" {
+		htmlTmpl, err := htmltemplate.New("html").Funcs(htmltemplate.FuncMap(templateFuncs())).Parse(htmlSrc)
+		if err != nil {
+			return nil, err
+		}
+		jt.html = htmlTmpl
+	}
+	return jt, nil
+}
+
+// render executes all of a job's templates against one recipient's context.
+func (jt *jobTemplates) render(ctx recipientContext) (renderedMessage, error) {
+	var subjectBuf, textBuf bytes.Buffer
+	if err := jt.subject.Execute(&subjectBuf, ctx); err != nil {
+		return renderedMessage{}, err
+	}
+	if err := jt.text.Execute(&textBuf, ctx); err != nil {
+		return renderedMessage{}, err
+	}
+
+	msg := renderedMessage{Subject: subjectBuf.String(), Text: textBuf.String()}
+	if jt.html != nil {
+		var htmlBuf bytes.Buffer
+		if err := jt.html.Execute(&htmlBuf, ctx); err != nil {
+			return renderedMessage{}, err
+		}
+		msg.HTML = htmlBuf.String()
+	}
+	return msg, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestParseAndRenderJobTemplates(t *testing.T) {
+	jt, err := parseJobTemplates(
+		"Hi {{.Attrs.name}}",
+		"Unsubscribe: {{.UnsubscribeURL}}",
+		"<p>Hi {{.Attrs.name}}</p>",
+	)
+	if err != nil {
+		t.Fatalf("parseJobTemplates: %v", err)
+	}
+
+	ctx := recipientContext{
+		Email:          "alice@example.com",
+		UnsubscribeURL: "https://example.com/unsubscribe?token=abc",
+		Attrs:          map[string]interface{}{"name": "Alice"},
+	}
+	msg, err := jt.render(ctx)
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if msg.Subject != "Hi Alice" {
+		t.Errorf("Subject = %q, want %q", msg.Subject, "Hi Alice")
+	}
+	if msg.Text != "Unsubscribe: https://example.com/unsubscribe?token=abc" {
+		t.Errorf("Text = %q", msg.Text)
+	}
+	if msg.HTML != "<p>Hi Alice</p>" {
+		t.Errorf("HTML = %q", msg.HTML)
+	}
+}
+
+func TestParseJobTemplatesTextOnly(t *testing.T) {
+	jt, err := parseJobTemplates("Subject", "Body", "")
+	if err != nil {
+		t.Fatalf("parseJobTemplates: %v", err)
+	}
+	if jt.html != nil {
+		t.Fatal("jt.html should be nil when htmlSrc is empty")
+	}
+	msg, err := jt.render(recipientContext{Email: "a@example.com"})
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if msg.HTML != "" {
+		t.Errorf("HTML = %q, want empty for a text-only job", msg.HTML)
+	}
+}
+
+func TestParseJobTemplatesInvalidSyntax(t *testing.T) {
+	if _, err := parseJobTemplates("{{.Bad", "text", ""); err == nil {
+		t.Fatal("parseJobTemplates accepted malformed template syntax")
+	}
+}
+
+func TestRenderUsesSprigFunctions(t *testing.T) {
+	jt, err := parseJobTemplates(`{{.Attrs.name | upper}}`, "text", "")
+	if err != nil {
+		t.Fatalf("parseJobTemplates: %v", err)
+	}
+	msg, err := jt.render(recipientContext{Attrs: map[string]interface{}{"name": "bob"}})
+	if err != nil {
+		t.Fatalf("render: %v", err)
+	}
+	if msg.Subject != "BOB" {
+		t.Errorf("Subject = %q, want %q (sprig upper func)", msg.Subject, "BOB")
+	}
+}